@@ -2,13 +2,12 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"strings"
 	"time"
@@ -31,22 +30,62 @@ type KnowledgeBase struct {
 	ResponseTemplates map[string]string `json:"response_template"`
 }
 
-type DeepSeekRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
+type Message struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Name       string     `json:"name,omitempty"`
 }
 
-type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+// ToolCall — запрос модели на вызов функции (формат OpenAI `tool_calls`).
+type ToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
 }
 
 var (
-	kb          KnowledgeBase
-	deepSeekURL = "https://api.deepseek.com/v1/chat/completions"
+	kb             KnowledgeBase
+	provider       Provider
+	streamOutput   bool
+	ragIndex       *RetrievalIndex
+	toolRegistry   ToolRegistry
+	historyEnabled bool
+	conversations  *ConversationManager
 )
 
+// topKTeams — сколько наиболее релевантных команд подмешивать в промпт вместо полного дампа базы.
+const topKTeams = 5
+
 func main() {
+	// Подкоманда `serve` запускает HTTP-сервер вместо интерактивного CLI.
+	serveMode := len(os.Args) > 1 && os.Args[1] == "serve"
+
+	var streamFlag *bool
+	var serveAddr *string
+	var serveWorkers *int
+	var insecureFlag *bool
+	if serveMode {
+		fs := flag.NewFlagSet("serve", flag.ExitOnError)
+		serveAddr = fs.String("addr", envOr("SERVE_ADDR", ":8080"), "адрес для HTTP-сервера")
+		serveWorkers = fs.Int("workers", 8, "размер пула воркеров для обработки запросов")
+		insecureFlag = fs.Bool("insecure", false, "отключить проверку TLS-сертификатов (только для локальной разработки!)")
+		fs.Parse(os.Args[2:])
+	} else {
+		streamFlag = flag.Bool("stream", false, "выводить ответ по мере генерации (SSE)")
+		insecureFlag = flag.Bool("insecure", false, "отключить проверку TLS-сертификатов (только для локальной разработки!)")
+		flag.Parse()
+		streamOutput = *streamFlag || os.Getenv("STREAM") == "1"
+	}
+	insecureTLS = *insecureFlag
+	if insecureTLS {
+		log.Println("⚠️ TLS-проверка отключена (--insecure) — не используйте это в продакшене")
+	}
+
 	// Загрузка .env
 	if err := godotenv.Load(); err != nil {
 		log.Println("⚠️ .env не загружен:", err)
@@ -57,6 +96,45 @@ func main() {
 		log.Fatal("❌ Ошибка загрузки базы знаний:", err)
 	}
 
+	// Выбор LLM-провайдера (LLM_PROVIDER=deepseek|openai|moonshot|gemini|ollama)
+	p, err := NewProvider()
+	if err != nil {
+		log.Fatal("❌ Ошибка инициализации провайдера:", err)
+	}
+	provider = p
+
+	// RAG-индекс: если эмбеддер недоступен (нет ключа), тихо откатываемся
+	// на полный дамп базы знаний в processQuery.
+	if embedder, err := newEmbedder(); err != nil {
+		log.Println("⚠️ RAG-индекс не построен, используется полный дамп базы:", err)
+	} else if idx, err := BuildRetrievalIndex(context.Background(), kb.Teams, embedder); err != nil {
+		log.Println("⚠️ Не удалось построить RAG-индекс, используется полный дамп базы:", err)
+	} else {
+		ragIndex = idx
+	}
+
+	toolRegistry = defaultToolRegistry()
+
+	// Память диалога: ENABLE_HISTORY=1 включает персистентные сессии с
+	// командами /new, /list, /load <id>, /forget.
+	historyEnabled = os.Getenv("ENABLE_HISTORY") == "1"
+	if historyEnabled {
+		store, err := openSessionStore(envOr("SESSIONS_DB", "sessions.db"))
+		if err != nil {
+			log.Fatal("❌ Не удалось открыть хранилище сессий:", err)
+		}
+		defer store.Close()
+		conversations = NewConversationManager(store, defaultTokenBudget)
+		conversations.NewSession()
+	}
+
+	if serveMode {
+		if err := runServer(*serveAddr, *serveWorkers); err != nil {
+			log.Fatal("❌ Сервер завершился с ошибкой:", err)
+		}
+		return
+	}
+
 	// CLI интерфейс
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("🤖 AI-агент техподдержки (JSON+RAG)")
@@ -71,10 +149,56 @@ func main() {
 			break
 		}
 
+		if historyEnabled && handleSessionCommand(query) {
+			continue
+		}
+
 		processQuery(query)
 	}
 }
 
+// handleSessionCommand обрабатывает команды /new, /list, /load <id>, /forget.
+// Возвращает true, если query была такой командой и обработка запроса не нужна.
+func handleSessionCommand(query string) bool {
+	switch {
+	case query == "/new":
+		sess := conversations.NewSession()
+		fmt.Println("🆕 Новая сессия:", sess.ID)
+		return true
+
+	case query == "/list":
+		sessions, err := conversations.List()
+		if err != nil {
+			log.Println("❌ Ошибка:", err)
+			return true
+		}
+		for _, s := range sessions {
+			fmt.Printf("%s  (%d реплик, обновлена %s)\n", s.ID, len(s.Messages), s.UpdatedAt.Format(time.RFC3339))
+		}
+		return true
+
+	case strings.HasPrefix(query, "/load "):
+		id := strings.TrimSpace(strings.TrimPrefix(query, "/load "))
+		if err := conversations.LoadSession(id); err != nil {
+			log.Println("❌ Ошибка:", err)
+			return true
+		}
+		fmt.Println("📂 Загружена сессия:", id)
+		return true
+
+	case query == "/forget":
+		sess := conversations.Current()
+		if err := conversations.Forget(sess.ID); err != nil {
+			log.Println("❌ Ошибка:", err)
+		}
+		conversations.NewSession()
+		fmt.Println("🗑️ Сессия забыта, начата новая")
+		return true
+	}
+
+	return false
+}
+
 func loadKnowledgeBase(filename string) error {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -89,17 +213,28 @@ func loadKnowledgeBase(filename string) error {
 	return nil
 }
 
-func processQuery(query string) {
-	// Формируем контекст для DeepSeek
-	context := struct {
+// buildMessages формирует промпт для запроса: если RAG-индекс построен,
+// подмешивает только top-K релевантных команд вместо всей базы знаний.
+func buildMessages(ctx context.Context, query string) []Message {
+	teams := kb.Teams
+	if ragIndex != nil {
+		top, err := ragIndex.TopK(ctx, query, topKTeams)
+		if err != nil {
+			log.Println("⚠️ RAG-поиск не удался, используется полная база:", err)
+		} else {
+			teams = top
+		}
+	}
+
+	promptContext := struct {
 		KnowledgeBase KnowledgeBase `json:"knowledge_base"`
 		UserQuery     string        `json:"user_query"`
 	}{
-		KnowledgeBase: kb,
+		KnowledgeBase: KnowledgeBase{Teams: teams, ResponseTemplates: kb.ResponseTemplates},
 		UserQuery:     query,
 	}
 
-	contextJSON, _ := json.MarshalIndent(context, "", "  ")
+	contextJSON, _ := json.MarshalIndent(promptContext, "", "  ")
 	fullPrompt := fmt.Sprintf(`
 Анализируй запрос используя ТОЛЬКО эту базу знаний:
 %s
@@ -111,76 +246,122 @@ func processQuery(query string) {
 		kb.ResponseTemplates["success"],
 		kb.ResponseTemplates["unknown"])
 
-	// Отправка в DeepSeek
-	response, err := askDeepSeek(fullPrompt)
+	return []Message{
+		{
+			Role:    "system",
+			Content: "Ты ИИ-ассистент техподдержки. Отвечай строго по предоставленной базе знаний.",
+		},
+		{
+			Role:    "user",
+			Content: fullPrompt,
+		},
+	}
+}
+
+// withHistory вставляет историю сессии sessionID между системным сообщением и
+// свежим запросом пользователя (который несёт полный RAG-контекст). Требует
+// явный sessionID — без него (HTTP-запрос без session_id) история не подмешивается,
+// чтобы разные вызывающие никогда не делили одну и ту же сессию.
+func withHistory(sessionID string, messages []Message) []Message {
+	if !historyEnabled || sessionID == "" {
+		return messages
+	}
+
+	history, err := conversations.History(sessionID)
 	if err != nil {
-		log.Println("❌ Ошибка:", err)
-		return
+		log.Println("⚠️ Не удалось загрузить историю сессии:", err)
+		return messages
 	}
 
-	fmt.Println("\n🤖 Ответ:")
-	fmt.Println(response)
+	system, user := messages[0], messages[1]
+	combined := append([]Message{system}, history...)
+	return append(combined, user)
 }
 
-func askDeepSeek(prompt string) (string, error) {
-	apiKey := os.Getenv("DEEPSEEK_API_KEY")
-	if apiKey == "" {
-		return "", fmt.Errorf("DEEPSEEK_API_KEY не найден")
-	}
-
-	requestBody := DeepSeekRequest{
-		Model: "deepseek-chat",
-		Messages: []Message{
-			{
-				Role:    "system",
-				Content: "Ты ИИ-ассистент техподдержки. Отвечай строго по предоставленной базе знаний.",
-			},
-			{
-				Role:    "user",
-				Content: prompt,
-			},
-		},
+// answerQuery прогоняет запрос через RAG и провайдера (с циклом вызова
+// инструментов, если зарегистрирован ToolRegistry), возвращая готовый ответ.
+// sessionID пустая строка означает запрос без памяти диалога.
+func answerQuery(ctx context.Context, sessionID, query string) (string, error) {
+	response, err := runToolLoop(ctx, withHistory(sessionID, buildMessages(ctx, query)), toolRegistry)
+	if err != nil {
+		return "", err
 	}
 
-	jsonBody, _ := json.Marshal(requestBody)
-	req, _ := http.NewRequest("POST", deepSeekURL, bytes.NewBuffer(jsonBody))
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
+	if historyEnabled && sessionID != "" {
+		if err := conversations.Append(ctx, sessionID, Message{Role: "user", Content: query}); err != nil {
+			log.Println("⚠️ Не удалось сохранить сообщение в сессию:", err)
+		}
+		if err := conversations.Append(ctx, sessionID, Message{Role: "assistant", Content: response}); err != nil {
+			log.Println("⚠️ Не удалось сохранить ответ в сессию:", err)
+		}
+	}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // Только для теста!
-		},
-		Timeout: 30 * time.Second,
+	return response, nil
+}
+
+// answerQueryStream — то же самое, но с выдачей дельт токенов через onDelta.
+//
+// Ограничение: в отличие от answerQuery, здесь нет runToolLoop — Provider.ChatStream
+// не принимает tools и не может вернуть tool_calls из потока дельт, поэтому
+// create_ticket/lookup_contact/search_knowledge в режиме --stream/STREAM=1
+// недоступны модели. Склеивание tool-calling с SSE-стримом требует разбора
+// потоковых tool_calls по чанкам (OpenAI шлёт их по кускам в delta.tool_calls)
+// и не реализовано — это явный, логируемый компромисс, а не тихий пропуск.
+func answerQueryStream(ctx context.Context, sessionID, query string, onDelta func(string)) error {
+	if toolRegistry != nil && len(toolRegistry.Specs()) > 0 {
+		log.Println("⚠️ Потоковый режим (--stream/STREAM=1) не поддерживает вызов инструментов — модель не увидит зарегистрированные tools")
 	}
-	resp, err := client.Do(req)
+
+	var full strings.Builder
+	err := provider.ChatStream(ctx, withHistory(sessionID, buildMessages(ctx, query)), func(delta string) {
+		full.WriteString(delta)
+		onDelta(delta)
+	})
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API ошибка %d: %s", resp.StatusCode, string(body))
+	if historyEnabled && sessionID != "" {
+		if err := conversations.Append(ctx, sessionID, Message{Role: "user", Content: query}); err != nil {
+			log.Println("⚠️ Не удалось сохранить сообщение в сессию:", err)
+		}
+		if err := conversations.Append(ctx, sessionID, Message{Role: "assistant", Content: full.String()}); err != nil {
+			log.Println("⚠️ Не удалось сохранить ответ в сессию:", err)
+		}
 	}
 
-	var result struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
+	return nil
+}
+
+func processQuery(query string) {
+	ctx := context.Background()
+
+	// В интерактивном CLI сессия одна на процесс — её ID берём из ConversationManager.
+	var sessionID string
+	if historyEnabled {
+		sessionID = conversations.Current().ID
 	}
 
-	if err := json.Unmarshal(body, &result); err != nil {
-		return "", err
+	if streamOutput {
+		fmt.Println("\n🤖 Ответ:")
+		if err := answerQueryStream(ctx, sessionID, query, func(delta string) {
+			fmt.Print(delta)
+		}); err != nil {
+			log.Println("\n❌ Ошибка:", err)
+			return
+		}
+		fmt.Println()
+		return
 	}
 
-	if len(result.Choices) == 0 {
-		return "", fmt.Errorf("пустой ответ API")
+	response, err := answerQuery(ctx, sessionID, query)
+	if err != nil {
+		log.Println("❌ Ошибка:", err)
+		return
 	}
 
-	return result.Choices[0].Message.Content, nil
+	fmt.Println("\n🤖 Ответ:")
+	fmt.Println(response)
 }
 
 func shouldExit(query string) bool {
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Provider — общий интерфейс для любого LLM-бэкенда.
+type Provider interface {
+	Chat(ctx context.Context, messages []Message) (string, error)
+	ChatStream(ctx context.Context, messages []Message, onDelta func(string)) error
+
+	// ChatWithTools отправляет messages вместе со списком доступных инструментов
+	// (формат OpenAI `tools`) и возвращает ответ ассистента как есть — либо
+	// финальный текст, либо запрос на вызов одного или нескольких ToolCalls.
+	// Провайдеры без собственной поддержки function-calling (Gemini, Ollama)
+	// игнорируют tools и ведут себя как обычный Chat.
+	ChatWithTools(ctx context.Context, messages []Message, tools []ToolSpec) (Message, error)
+}
+
+// ProviderConfig собирается из переменных окружения конкретного провайдера.
+type ProviderConfig struct {
+	Name    string
+	BaseURL string
+	Model   string
+	APIKey  string
+}
+
+// NewProvider выбирает провайдера по LLM_PROVIDER (по умолчанию "deepseek").
+func NewProvider() (Provider, error) {
+	name := strings.ToLower(os.Getenv("LLM_PROVIDER"))
+	if name == "" {
+		name = "deepseek"
+	}
+
+	switch name {
+	case "deepseek":
+		return newOpenAICompatProvider(ProviderConfig{
+			Name:    "deepseek",
+			BaseURL: envOr("DEEPSEEK_BASE_URL", "https://api.deepseek.com/v1/chat/completions"),
+			Model:   envOr("DEEPSEEK_MODEL", "deepseek-chat"),
+			APIKey:  os.Getenv("DEEPSEEK_API_KEY"),
+		})
+	case "openai":
+		return newOpenAICompatProvider(ProviderConfig{
+			Name:    "openai",
+			BaseURL: envOr("OPENAI_BASE_URL", "https://api.openai.com/v1/chat/completions"),
+			Model:   envOr("OPENAI_MODEL", "gpt-4o-mini"),
+			APIKey:  os.Getenv("OPENAI_API_KEY"),
+		})
+	case "moonshot":
+		return newOpenAICompatProvider(ProviderConfig{
+			Name:    "moonshot",
+			BaseURL: envOr("MOONSHOT_BASE_URL", "https://api.moonshot.cn/v1/chat/completions"),
+			Model:   envOr("MOONSHOT_MODEL", "moonshot-v1-8k"),
+			APIKey:  os.Getenv("MOONSHOT_API_KEY"),
+		})
+	case "gemini":
+		return newGeminiProvider(ProviderConfig{
+			Name:    "gemini",
+			BaseURL: envOr("GEMINI_BASE_URL", "https://generativelanguage.googleapis.com/v1beta/models"),
+			Model:   envOr("GEMINI_MODEL", "gemini-1.5-flash"),
+			APIKey:  os.Getenv("GEMINI_API_KEY"),
+		})
+	case "ollama":
+		return newOllamaProvider(ProviderConfig{
+			Name:    "ollama",
+			BaseURL: envOr("OLLAMA_BASE_URL", "http://localhost:11434"),
+			Model:   envOr("OLLAMA_MODEL", "llama3"),
+		})
+	default:
+		return nil, fmt.Errorf("неизвестный LLM_PROVIDER: %s", name)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// ---- OpenAI-совместимые провайдеры (DeepSeek, OpenAI, Moonshot) ----
+
+type openAICompatProvider struct {
+	cfg ProviderConfig
+	// client обслуживает обычные (нестриминговые) запросы — с client.Timeout,
+	// т.к. там нет долгоживущего чтения тела.
+	client *http.Client
+	// streamClient — без client.Timeout: Client.Timeout покрывает всё чтение
+	// тела ответа, а не только заголовки, так что для SSE-стрима единственный
+	// дедлайн должен идти через ctx (requestContext в вызывающем коде), а не
+	// обрывать соединение на середине долгого ответа.
+	streamClient *http.Client
+}
+
+func newOpenAICompatProvider(cfg ProviderConfig) (*openAICompatProvider, error) {
+	if cfg.APIKey == "" {
+		return nil, fmt.Errorf("%s: не найден API-ключ", cfg.Name)
+	}
+	client, err := newHTTPClient(defaultRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	streamClient, err := newHTTPClient(0)
+	if err != nil {
+		return nil, err
+	}
+	return &openAICompatProvider{cfg: cfg, client: client, streamClient: streamClient}, nil
+}
+
+type openAIChatRequest struct {
+	Model    string           `json:"model"`
+	Messages []Message        `json:"messages"`
+	Stream   bool             `json:"stream,omitempty"`
+	Tools    []openAIToolSpec `json:"tools,omitempty"`
+}
+
+// openAIToolSpec — описание функции в формате OpenAI `tools`.
+type openAIToolSpec struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Parameters  map[string]interface{} `json:"parameters"`
+	} `json:"function"`
+}
+
+func toOpenAIToolSpecs(tools []ToolSpec) []openAIToolSpec {
+	specs := make([]openAIToolSpec, len(tools))
+	for i, t := range tools {
+		specs[i].Type = "function"
+		specs[i].Function.Name = t.Name
+		specs[i].Function.Description = t.Description
+		specs[i].Function.Parameters = t.Parameters
+	}
+	return specs
+}
+
+func (p *openAICompatProvider) Chat(ctx context.Context, messages []Message) (string, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	reqBody := openAIChatRequest{Model: p.cfg.Model, Messages: messages}
+	jsonBody, _ := json.Marshal(reqBody)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.cfg.BaseURL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.cfg.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s API ошибка %d: %s", p.cfg.Name, resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	if len(result.Choices) == 0 {
+		return "", fmt.Errorf("%s: пустой ответ API", p.cfg.Name)
+	}
+
+	return result.Choices[0].Message.Content, nil
+}
+
+// ChatWithTools — как Chat, но с полем tools и разбором возможного tool_calls
+// в ответе ассистента вместо одной лишь текстовой content.
+func (p *openAICompatProvider) ChatWithTools(ctx context.Context, messages []Message, tools []ToolSpec) (Message, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	reqBody := openAIChatRequest{Model: p.cfg.Model, Messages: messages, Tools: toOpenAIToolSpecs(tools)}
+	jsonBody, _ := json.Marshal(reqBody)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.cfg.BaseURL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return Message{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.cfg.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Message{}, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return Message{}, fmt.Errorf("%s API ошибка %d: %s", p.cfg.Name, resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Choices []struct {
+			Message Message `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return Message{}, err
+	}
+	if len(result.Choices) == 0 {
+		return Message{}, fmt.Errorf("%s: пустой ответ API", p.cfg.Name)
+	}
+
+	return result.Choices[0].Message, nil
+}
+
+// ChatStream включает stream: true и построчно разбирает SSE-события
+// вида "data: {...}", отдавая дельты токенов в onDelta по мере поступления.
+func (p *openAICompatProvider) ChatStream(ctx context.Context, messages []Message, onDelta func(string)) error {
+	reqBody := openAIChatRequest{Model: p.cfg.Model, Messages: messages, Stream: true}
+	jsonBody, _ := json.Marshal(reqBody)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.cfg.BaseURL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.cfg.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := p.streamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s API ошибка %d: %s", p.cfg.Name, resp.StatusCode, string(body))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		payload := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if payload == "[DONE]" {
+			break
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			continue
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if delta := chunk.Choices[0].Delta.Content; delta != "" {
+			onDelta(delta)
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// ---- Gemini (собственная схема запроса/ответа) ----
+
+type geminiProvider struct {
+	cfg    ProviderConfig
+	client *http.Client
+}
+
+func newGeminiProvider(cfg ProviderConfig) (*geminiProvider, error) {
+	if cfg.APIKey == "" {
+		return nil, fmt.Errorf("gemini: не найден API-ключ")
+	}
+	client, err := newHTTPClient(defaultRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &geminiProvider{cfg: cfg, client: client}, nil
+}
+
+type geminiContent struct {
+	Role  string `json:"role"`
+	Parts []struct {
+		Text string `json:"text"`
+	} `json:"parts"`
+}
+
+type geminiRequest struct {
+	Contents []geminiContent `json:"contents"`
+}
+
+func (p *geminiProvider) Chat(ctx context.Context, messages []Message) (string, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s:generateContent?key=%s", p.cfg.BaseURL, p.cfg.Model, p.cfg.APIKey)
+
+	reqBody := geminiRequest{}
+	for _, m := range messages {
+		role := "user"
+		if m.Role == "assistant" {
+			role = "model"
+		}
+		content := geminiContent{Role: role}
+		content.Parts = append(content.Parts, struct {
+			Text string `json:"text"`
+		}{Text: m.Content})
+		reqBody.Contents = append(reqBody.Contents, content)
+	}
+	jsonBody, _ := json.Marshal(reqBody)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gemini API ошибка %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Candidates []struct {
+			Content struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"content"`
+		} `json:"candidates"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	if len(result.Candidates) == 0 || len(result.Candidates[0].Content.Parts) == 0 {
+		return "", fmt.Errorf("gemini: пустой ответ API")
+	}
+
+	return result.Candidates[0].Content.Parts[0].Text, nil
+}
+
+func (p *geminiProvider) ChatStream(ctx context.Context, messages []Message, onDelta func(string)) error {
+	content, err := p.Chat(ctx, messages)
+	if err != nil {
+		return err
+	}
+	onDelta(content)
+	return nil
+}
+
+// ChatWithTools: Gemini не поддерживается здесь, tools игнорируются.
+func (p *geminiProvider) ChatWithTools(ctx context.Context, messages []Message, tools []ToolSpec) (Message, error) {
+	content, err := p.Chat(ctx, messages)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Role: "assistant", Content: content}, nil
+}
+
+// ---- Ollama (локальный инференс, своя схема) ----
+
+type ollamaProvider struct {
+	cfg    ProviderConfig
+	client *http.Client
+}
+
+func newOllamaProvider(cfg ProviderConfig) (*ollamaProvider, error) {
+	client, err := newHTTPClient(60 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &ollamaProvider{cfg: cfg, client: client}, nil
+}
+
+type ollamaChatRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream"`
+}
+
+func (p *ollamaProvider) Chat(ctx context.Context, messages []Message) (string, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	reqBody := ollamaChatRequest{Model: p.cfg.Model, Messages: messages, Stream: false}
+	jsonBody, _ := json.Marshal(reqBody)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.cfg.BaseURL+"/api/chat", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ollama API ошибка %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+
+	return result.Message.Content, nil
+}
+
+func (p *ollamaProvider) ChatStream(ctx context.Context, messages []Message, onDelta func(string)) error {
+	content, err := p.Chat(ctx, messages)
+	if err != nil {
+		return err
+	}
+	onDelta(content)
+	return nil
+}
+
+// ChatWithTools: локальная модель Ollama здесь не поддерживается, tools игнорируются.
+func (p *ollamaProvider) ChatWithTools(ctx context.Context, messages []Message, tools []ToolSpec) (Message, error) {
+	content, err := p.Chat(ctx, messages)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Role: "assistant", Content: content}, nil
+}
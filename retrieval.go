@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+const embeddingsCacheFile = "knowledge_base.embeddings.gob"
+
+// Вес векторного сходства против BM25/keyword-скора при слиянии.
+const (
+	vectorWeight  = 0.7
+	keywordWeight = 0.3
+)
+
+// Embedder считает вектор эмбеддинга для произвольного текста.
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float32, error)
+}
+
+type httpEmbedder struct {
+	baseURL string
+	model   string
+	apiKey  string
+	client  *http.Client
+}
+
+// newEmbedder строит эмбеддер поверх DeepSeek/OpenAI-совместимого /v1/embeddings.
+// Если ключа нет ни у одного из известных провайдеров, RAG-индекс не строится
+// и процессQuery откатывается на старый полный дамп базы знаний.
+func newEmbedder() (Embedder, error) {
+	baseURL := os.Getenv("EMBEDDING_BASE_URL")
+	model := envOr("EMBEDDING_MODEL", "text-embedding-3-small")
+	apiKey := os.Getenv("EMBEDDING_API_KEY")
+
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAI_API_KEY")
+		if baseURL == "" && apiKey != "" {
+			baseURL = "https://api.openai.com/v1/embeddings"
+		}
+	}
+	if apiKey == "" {
+		apiKey = os.Getenv("DEEPSEEK_API_KEY")
+		if baseURL == "" && apiKey != "" {
+			baseURL = "https://api.deepseek.com/v1/embeddings"
+		}
+	}
+	if apiKey == "" {
+		return nil, fmt.Errorf("не найден ключ ни для одного embeddings-провайдера")
+	}
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1/embeddings"
+	}
+
+	client, err := newHTTPClient(defaultRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &httpEmbedder{baseURL: baseURL, model: model, apiKey: apiKey, client: client}, nil
+}
+
+func (e *httpEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	reqBody := struct {
+		Model string `json:"model"`
+		Input string `json:"input"`
+	}{Model: e.model, Input: text}
+	jsonBody, _ := json.Marshal(reqBody)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.baseURL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embeddings API ошибка %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 {
+		return nil, fmt.Errorf("embeddings: пустой ответ API")
+	}
+
+	return result.Data[0].Embedding, nil
+}
+
+// RetrievalIndex — in-memory векторный индекс команд с keyword-фолбэком (BM25).
+type RetrievalIndex struct {
+	embedder  Embedder
+	cachePath string
+
+	teams   []Team
+	vectors [][]float32
+
+	docFreq   map[string]int
+	avgDocLen float64
+	docTokens []map[string]int
+	docLens   []int
+}
+
+// cachedEmbedding — запись в knowledge_base.embeddings.gob, ключ — sha256 текста команды.
+type embeddingCache map[string][]float32
+
+// teamSourceText — конкатенация полей команды, используемая и для эмбеддинга, и для BM25.
+func teamSourceText(t Team) string {
+	return strings.Join([]string{
+		t.Name,
+		t.Description,
+		strings.Join(t.Keywords, " "),
+		strings.Join(t.Examples, " "),
+		strings.Join(t.Tags, " "),
+	}, "\n")
+}
+
+func hashText(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadEmbeddingCache(path string) embeddingCache {
+	cache := embeddingCache{}
+	f, err := os.Open(path)
+	if err != nil {
+		return cache
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&cache); err != nil {
+		log.Println("⚠️ Кэш эмбеддингов повреждён, пересчитываем:", err)
+		return embeddingCache{}
+	}
+	return cache
+}
+
+func saveEmbeddingCache(path string, cache embeddingCache) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewEncoder(f).Encode(cache)
+}
+
+// BuildRetrievalIndex эмбеддит каждую команду (с диск-кэшем по хэшу текста)
+// и готовит BM25-статистику для keyword-фолбэка.
+func BuildRetrievalIndex(ctx context.Context, teams []Team, embedder Embedder) (*RetrievalIndex, error) {
+	cache := loadEmbeddingCache(embeddingsCacheFile)
+	dirty := false
+
+	idx := &RetrievalIndex{
+		embedder:  embedder,
+		cachePath: embeddingsCacheFile,
+		teams:     teams,
+	}
+
+	for _, t := range teams {
+		text := teamSourceText(t)
+		hash := hashText(text)
+
+		vec, ok := cache[hash]
+		if !ok {
+			v, err := embedder.Embed(ctx, text)
+			if err != nil {
+				return nil, fmt.Errorf("эмбеддинг команды %q: %w", t.Name, err)
+			}
+			vec = v
+			cache[hash] = vec
+			dirty = true
+		}
+		idx.vectors = append(idx.vectors, vec)
+
+		tokens := tokenize(text)
+		freq := map[string]int{}
+		for _, tok := range tokens {
+			freq[tok]++
+		}
+		idx.docTokens = append(idx.docTokens, freq)
+		idx.docLens = append(idx.docLens, len(tokens))
+	}
+
+	idx.docFreq = map[string]int{}
+	totalLen := 0
+	for _, freq := range idx.docTokens {
+		for tok := range freq {
+			idx.docFreq[tok]++
+		}
+	}
+	for _, l := range idx.docLens {
+		totalLen += l
+	}
+	if len(teams) > 0 {
+		idx.avgDocLen = float64(totalLen) / float64(len(teams))
+	}
+
+	if dirty {
+		if err := saveEmbeddingCache(embeddingsCacheFile, cache); err != nil {
+			log.Println("⚠️ Не удалось сохранить кэш эмбеддингов:", err)
+		}
+	}
+
+	log.Printf("✅ RAG-индекс построен: %d команд", len(teams))
+	return idx, nil
+}
+
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'а' && r <= 'я' || r >= '0' && r <= '9')
+	})
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, normA, normB float64
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+const bm25K1 = 1.5
+const bm25B = 0.75
+
+func (idx *RetrievalIndex) bm25Score(docIdx int, queryTokens []string) float64 {
+	freq := idx.docTokens[docIdx]
+	docLen := float64(idx.docLens[docIdx])
+	n := float64(len(idx.teams))
+
+	var score float64
+	for _, tok := range queryTokens {
+		f := float64(freq[tok])
+		if f == 0 {
+			continue
+		}
+		df := float64(idx.docFreq[tok])
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		score += idf * (f * (bm25K1 + 1)) / (f + bm25K1*(1-bm25B+bm25B*docLen/idx.avgDocLen))
+	}
+	return score
+}
+
+// scoredTeam — промежуточный результат слияния векторного и keyword-скора.
+type scoredTeam struct {
+	team  Team
+	score float64
+}
+
+// TopK возвращает k наиболее релевантных команд для запроса. Команды, у
+// которых запрос содержит одно из слов Exclusions, отсекаются полностью —
+// это жёсткий фильтр, а не часть взвешенного скора.
+func (idx *RetrievalIndex) TopK(ctx context.Context, query string, k int) ([]Team, error) {
+	queryVec, err := idx.embedder.Embed(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("эмбеддинг запроса: %w", err)
+	}
+	queryTokens := tokenize(query)
+	lowerQuery := strings.ToLower(query)
+
+	var candidates []scoredTeam
+	for i, t := range idx.teams {
+		if teamExcluded(t, lowerQuery) {
+			continue
+		}
+
+		cos := cosineSimilarity(queryVec, idx.vectors[i])
+		bm25 := idx.bm25Score(i, queryTokens)
+		// BM25 не нормирован в [0,1], но для малого корпуса команд этого
+		// достаточно, чтобы точные совпадения по ключевым словам перевешивали
+		// близкие, но нерелевантные векторные соседи.
+		score := vectorWeight*cos + keywordWeight*bm25
+		candidates = append(candidates, scoredTeam{team: t, score: score})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	if k > len(candidates) {
+		k = len(candidates)
+	}
+	top := make([]Team, k)
+	for i := 0; i < k; i++ {
+		top[i] = candidates[i].team
+	}
+	return top, nil
+}
+
+func teamExcluded(t Team, lowerQuery string) bool {
+	for _, excl := range t.Exclusions {
+		if excl == "" {
+			continue
+		}
+		if strings.Contains(lowerQuery, strings.ToLower(excl)) {
+			return true
+		}
+	}
+	return false
+}
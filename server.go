@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// workerPool ограничивает число одновременно обрабатываемых запросов к LLM.
+type workerPool struct {
+	sem chan struct{}
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size <= 0 {
+		size = 8
+	}
+	return &workerPool{sem: make(chan struct{}, size)}
+}
+
+func (p *workerPool) acquire() {
+	p.sem <- struct{}{}
+}
+
+func (p *workerPool) release() {
+	<-p.sem
+}
+
+// runServer поднимает HTTP-сервер в режиме `serve`.
+func runServer(addr string, workers int) error {
+	pool := newWorkerPool(workers)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/query", withWorkerPool(pool, handleQuery))
+	mux.HandleFunc("/v1/chat/completions", withWorkerPool(pool, handleChatCompletions))
+
+	log.Printf("✅ HTTP-сервер запущен на %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func withWorkerPool(pool *workerPool, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pool.acquire()
+		defer pool.release()
+		handler(w, r)
+	}
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// queryRequest/queryResponse — простая форма `{query: "..."}`. SessionID —
+// опциональный ключ памяти диалога (chunk0-7); без него запрос не получает
+// и не сохраняет историю, чтобы разные вызывающие не делили одну сессию.
+type queryRequest struct {
+	Query     string `json:"query"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+type queryResponse struct {
+	Response string `json:"response"`
+}
+
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req queryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := answerQuery(r.Context(), req.SessionID, req.Query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queryResponse{Response: response})
+}
+
+// chatCompletionsRequest/Response — подмножество схемы OpenAI `/v1/chat/completions`,
+// достаточное для совместимости с существующими клиентскими SDK.
+type chatCompletionsRequest struct {
+	Model     string    `json:"model"`
+	Messages  []Message `json:"messages"`
+	Stream    bool      `json:"stream"`
+	SessionID string    `json:"session_id,omitempty"`
+}
+
+type chatCompletionChoice struct {
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+type chatCompletionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type chatCompletionsResponse struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []chatCompletionChoice `json:"choices"`
+	Usage   chatCompletionUsage    `json:"usage"`
+}
+
+func lastUserMessage(messages []Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
+
+func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req chatCompletionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "некорректный JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := lastUserMessage(req.Messages)
+
+	if req.Stream {
+		serveChatCompletionsStream(w, r.Context(), req.Model, req.SessionID, query)
+		return
+	}
+
+	response, err := answerQuery(r.Context(), req.SessionID, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	promptTokens := estimateTokens(req.Messages)
+	completionTokens := estimateTokens([]Message{{Content: response}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chatCompletionsResponse{
+		ID:      "chatcmpl-local",
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []chatCompletionChoice{
+			{Index: 0, Message: Message{Role: "assistant", Content: response}, FinishReason: "stop"},
+		},
+		Usage: chatCompletionUsage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	})
+}
+
+func serveChatCompletionsStream(w http.ResponseWriter, ctx context.Context, model, sessionID, query string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming не поддерживается", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	err := answerQueryStream(ctx, sessionID, query, func(delta string) {
+		chunk := map[string]interface{}{
+			"id":      "chatcmpl-local",
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []map[string]interface{}{
+				{"index": 0, "delta": map[string]string{"content": delta}},
+			},
+		}
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	})
+	if err != nil {
+		// Ошибка на середине стрима должна быть видна клиенту, а не только в
+		// логе — иначе клиент получает [DONE] и думает, что ответ полный,
+		// хотя он оборван. Шлём это как одно SSE-событие с полем error и НЕ
+		// отправляем [DONE] следом, чтобы клиент мог отличить обрыв от успеха.
+		log.Println("❌ Ошибка стриминга:", err)
+		errChunk := map[string]interface{}{
+			"error": map[string]string{
+				"message": err.Error(),
+				"type":    "server_error",
+			},
+		}
+		data, _ := json.Marshal(errChunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+		return
+	}
+
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const sessionsBucket = "sessions"
+
+// defaultTokenBudget — с каким бюджетом токенов хранится история одной сессии
+// до автоматической суммаризации более старых реплик.
+const defaultTokenBudget = 3000
+
+// Session — одна сессия диалога с полной историей сообщений.
+type Session struct {
+	ID        string
+	Messages  []Message
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// SessionStore персистит сессии в локальный BoltDB-файл, по одной записи на ID.
+type SessionStore struct {
+	db *bolt.DB
+}
+
+func openSessionStore(path string) (*SessionStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("открытие %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(sessionsBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SessionStore{db: db}, nil
+}
+
+func (s *SessionStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SessionStore) Save(sess *Session) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sess); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(sessionsBucket)).Put([]byte(sess.ID), buf.Bytes())
+	})
+}
+
+func (s *SessionStore) Load(id string) (*Session, error) {
+	var sess Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(sessionsBucket)).Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("сессия не найдена: %s", id)
+		}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(&sess)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (s *SessionStore) List() ([]*Session, error) {
+	var sessions []*Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(sessionsBucket)).ForEach(func(k, v []byte) error {
+			var sess Session
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&sess); err != nil {
+				return err
+			}
+			sessions = append(sessions, &sess)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt)
+	})
+	return sessions, nil
+}
+
+func (s *SessionStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(sessionsBucket)).Delete([]byte(id))
+	})
+}
+
+func newSessionID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sessionHandle guards one in-memory Session with its own mutex, so mutating
+// its Messages (Append) can never race with reading them for persistence
+// (Save). A single shared session handle would otherwise race — and leak
+// turns across callers — under the chunk0-4 HTTP server's concurrent handlers.
+type sessionHandle struct {
+	mu   sync.Mutex
+	sess *Session
+}
+
+// ConversationManager кэширует по одному sessionHandle на сессию, так что
+// конкурентные запросы к РАЗНЫМ сессиям не блокируют друг друга, а запросы к
+// ОДНОЙ сессии всегда сериализуются через мьютекс её handle. currentID
+// используется только интерактивным CLI-циклом в main(); HTTP-обработчики
+// всегда должны передавать явный sessionID, а не полагаться на него.
+type ConversationManager struct {
+	store       *SessionStore
+	tokenBudget int
+
+	mu        sync.Mutex
+	handles   map[string]*sessionHandle
+	currentID string
+}
+
+func NewConversationManager(store *SessionStore, tokenBudget int) *ConversationManager {
+	if tokenBudget <= 0 {
+		tokenBudget = defaultTokenBudget
+	}
+	return &ConversationManager{store: store, tokenBudget: tokenBudget, handles: map[string]*sessionHandle{}}
+}
+
+func (m *ConversationManager) registerHandle(sess *Session) *sessionHandle {
+	h := &sessionHandle{sess: sess}
+	m.mu.Lock()
+	m.handles[sess.ID] = h
+	m.mu.Unlock()
+	return h
+}
+
+// handle возвращает закэшированный sessionHandle для id, подгружая сессию из
+// SessionStore и кэшируя её, если она ещё не в памяти. Незнакомый id — ошибка;
+// используется там, где это и должно быть ошибкой (LoadSession).
+func (m *ConversationManager) handle(id string) (*sessionHandle, error) {
+	m.mu.Lock()
+	h, ok := m.handles[id]
+	m.mu.Unlock()
+	if ok {
+		return h, nil
+	}
+
+	sess, err := m.store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.registerHandle(sess), nil
+}
+
+// getOrCreateHandle — как handle, но заводит и персистит новую пустую сессию
+// с этим id, если она нигде не найдена. HTTP-обработчики (server.go) передают
+// session_id, который клиент придумал сам, без отдельного endpoint для
+// создания сессии — Append/History должны уметь увидеть такой id впервые,
+// иначе память диалога через HTTP никогда не работает.
+func (m *ConversationManager) getOrCreateHandle(id string) (*sessionHandle, error) {
+	if h, err := m.handle(id); err == nil {
+		return h, nil
+	}
+
+	sess := &Session{ID: id, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	if err := m.store.Save(sess); err != nil {
+		return nil, err
+	}
+	return m.registerHandle(sess), nil
+}
+
+// NewSession начинает новую пустую сессию, делает её текущей для CLI и возвращает её.
+func (m *ConversationManager) NewSession() *Session {
+	sess := &Session{ID: newSessionID(), CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	m.registerHandle(sess)
+
+	m.mu.Lock()
+	m.currentID = sess.ID
+	m.mu.Unlock()
+
+	return sess
+}
+
+// LoadSession делает существующую сессию текущей для CLI.
+func (m *ConversationManager) LoadSession(id string) error {
+	if _, err := m.handle(id); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.currentID = id
+	m.mu.Unlock()
+	return nil
+}
+
+// Current возвращает текущую (CLI) сессию, создавая новую при первом обращении.
+func (m *ConversationManager) Current() *Session {
+	m.mu.Lock()
+	id := m.currentID
+	m.mu.Unlock()
+
+	if id == "" {
+		return m.NewSession()
+	}
+	h, err := m.handle(id)
+	if err != nil {
+		return m.NewSession()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sess
+}
+
+// Forget удаляет сессию из хранилища и из кэша.
+func (m *ConversationManager) Forget(id string) error {
+	m.mu.Lock()
+	delete(m.handles, id)
+	m.mu.Unlock()
+	return m.store.Delete(id)
+}
+
+// List возвращает все персистентные сессии.
+func (m *ConversationManager) List() ([]*Session, error) {
+	return m.store.List()
+}
+
+// Append добавляет реплику в сессию id и персистит её. Чтение истории,
+// суммаризация по бюджету и сохранение идут под мьютексом handle этой
+// сессии — конкурентный Append/History на ту же сессию не гонится за срез
+// Messages, а конкурентные запросы к другим сессиям не блокируются.
+func (m *ConversationManager) Append(ctx context.Context, id string, msg Message) error {
+	h, err := m.getOrCreateHandle(id)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sess.Messages = append(h.sess.Messages, msg)
+	h.sess.UpdatedAt = time.Now()
+
+	if err := m.enforceBudget(ctx, h.sess); err != nil {
+		log.Println("⚠️ Суммаризация истории не удалась:", err)
+	}
+
+	return m.store.Save(h.sess)
+}
+
+// History возвращает копию накопленных сообщений сессии id. Если id ещё
+// нигде не встречался (первый HTTP-запрос с новым session_id), заводит для
+// него пустую сессию вместо ошибки — см. getOrCreateHandle.
+func (m *ConversationManager) History(id string) ([]Message, error) {
+	h, err := m.getOrCreateHandle(id)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	history := make([]Message, len(h.sess.Messages))
+	copy(history, h.sess.Messages)
+	return history, nil
+}
+
+// estimateTokens — грубая оценка числа токенов: ~4 символа на токен.
+func estimateTokens(messages []Message) int {
+	total := 0
+	for _, msg := range messages {
+		total += len(msg.Content) / 4
+	}
+	return total
+}
+
+// enforceBudget суммаризирует самую старую половину истории одним вызовом
+// модели, когда общий объём превышает tokenBudget, заменяя её на одно
+// системное сообщение-резюме. Вызывается из Append, которая уже держит
+// мьютекс sess — sess передаётся явно, а не через Current().
+func (m *ConversationManager) enforceBudget(ctx context.Context, sess *Session) error {
+	if estimateTokens(sess.Messages) <= m.tokenBudget {
+		return nil
+	}
+
+	cut := len(sess.Messages) / 2
+	if cut == 0 {
+		return nil
+	}
+	older, recent := sess.Messages[:cut], sess.Messages[cut:]
+
+	var transcript bytes.Buffer
+	for _, msg := range older {
+		fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, msg.Content)
+	}
+
+	summary, err := provider.Chat(ctx, []Message{
+		{Role: "system", Content: "Сожми следующий диалог в краткое резюме на несколько предложений, сохранив важные факты и договорённости."},
+		{Role: "user", Content: transcript.String()},
+	})
+	if err != nil {
+		return err
+	}
+
+	summaryMsg := Message{Role: "system", Content: "Резюме более ранней части разговора: " + summary}
+	sess.Messages = append([]Message{summaryMsg}, recent...)
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxToolLoopIterations ограничивает число раундов вызова модели в runToolLoop,
+// чтобы зацикленный tool_calls не вис бесконечно.
+const maxToolLoopIterations = 5
+
+// ToolSpec описывает функцию, доступную модели, в независимом от провайдера виде.
+type ToolSpec struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{}
+}
+
+// ToolHandler выполняет инструмент по сырым JSON-аргументам модели.
+type ToolHandler func(ctx context.Context, args json.RawMessage) (string, error)
+
+// ToolRegistry — реестр инструментов, пригодный для подмены на свою систему
+// тикетов (Jira, Zendesk, внутреннее API) без изменений в runToolLoop.
+type ToolRegistry interface {
+	Specs() []ToolSpec
+	Call(ctx context.Context, name string, args json.RawMessage) (string, error)
+}
+
+type toolRegistryImpl struct {
+	specs    []ToolSpec
+	handlers map[string]ToolHandler
+}
+
+// NewToolRegistry создаёт пустой реестр инструментов.
+func NewToolRegistry() *toolRegistryImpl {
+	return &toolRegistryImpl{handlers: map[string]ToolHandler{}}
+}
+
+// Register добавляет инструмент в реестр.
+func (r *toolRegistryImpl) Register(spec ToolSpec, handler ToolHandler) {
+	r.specs = append(r.specs, spec)
+	r.handlers[spec.Name] = handler
+}
+
+func (r *toolRegistryImpl) Specs() []ToolSpec {
+	return r.specs
+}
+
+func (r *toolRegistryImpl) Call(ctx context.Context, name string, args json.RawMessage) (string, error) {
+	handler, ok := r.handlers[name]
+	if !ok {
+		return "", fmt.Errorf("неизвестный инструмент: %s", name)
+	}
+	return handler(ctx, args)
+}
+
+// defaultToolRegistry регистрирует встроенные инструменты техподдержки.
+func defaultToolRegistry() ToolRegistry {
+	r := NewToolRegistry()
+
+	r.Register(ToolSpec{
+		Name:        "create_ticket",
+		Description: "Создать тикет в системе поддержки для указанной команды",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"team":     map[string]interface{}{"type": "string", "description": "Название команды-владельца"},
+				"summary":  map[string]interface{}{"type": "string", "description": "Краткое описание проблемы"},
+				"priority": map[string]interface{}{"type": "string", "enum": []string{"low", "normal", "high", "urgent"}},
+			},
+			"required": []string{"team", "summary"},
+		},
+	}, handleCreateTicket)
+
+	r.Register(ToolSpec{
+		Name:        "lookup_contact",
+		Description: "Найти контакт команды для указанного канала связи (slack, email, phone)",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"team":    map[string]interface{}{"type": "string", "description": "Название команды"},
+				"channel": map[string]interface{}{"type": "string", "description": "Канал связи, например slack или email"},
+			},
+			"required": []string{"team"},
+		},
+	}, handleLookupContact)
+
+	r.Register(ToolSpec{
+		Name:        "search_knowledge",
+		Description: "Найти наиболее релевантные команды в базе знаний по запросу",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"query": map[string]interface{}{"type": "string", "description": "Поисковый запрос"},
+			},
+			"required": []string{"query"},
+		},
+	}, handleSearchKnowledge)
+
+	return r
+}
+
+func handleCreateTicket(ctx context.Context, args json.RawMessage) (string, error) {
+	var params struct {
+		Team     string `json:"team"`
+		Summary  string `json:"summary"`
+		Priority string `json:"priority"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("некорректные аргументы create_ticket: %w", err)
+	}
+	if params.Priority == "" {
+		params.Priority = "normal"
+	}
+
+	// Здесь пока нет интеграции с реальной системой тикетов — возвращаем
+	// заглушку-подтверждение, которую модель сможет показать пользователю.
+	// ticket_id — чистый хэш team+summary без таймстампа/счётчика, так что
+	// два разных тикета с одинаковыми team и summary получат один и тот же
+	// id; это осознанное упрощение заглушки, а не попытка гарантировать
+	// уникальность.
+	result := map[string]string{
+		"status":    "created",
+		"team":      params.Team,
+		"summary":   params.Summary,
+		"priority":  params.Priority,
+		"ticket_id": "TCK-" + hashText(params.Team+params.Summary)[:8],
+	}
+	data, _ := json.Marshal(result)
+	return string(data), nil
+}
+
+func handleLookupContact(ctx context.Context, args json.RawMessage) (string, error) {
+	var params struct {
+		Team    string `json:"team"`
+		Channel string `json:"channel"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("некорректные аргументы lookup_contact: %w", err)
+	}
+
+	for _, t := range kb.Teams {
+		if !strings.EqualFold(t.Name, params.Team) {
+			continue
+		}
+		if params.Channel != "" {
+			if contact, ok := t.Contacts[params.Channel]; ok {
+				return contact, nil
+			}
+			return "", fmt.Errorf("у команды %s нет контакта для канала %s", params.Team, params.Channel)
+		}
+		data, _ := json.Marshal(t.Contacts)
+		return string(data), nil
+	}
+
+	return "", fmt.Errorf("команда не найдена: %s", params.Team)
+}
+
+func handleSearchKnowledge(ctx context.Context, args json.RawMessage) (string, error) {
+	var params struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("некорректные аргументы search_knowledge: %w", err)
+	}
+
+	teams := kb.Teams
+	if ragIndex != nil {
+		top, err := ragIndex.TopK(ctx, params.Query, topKTeams)
+		if err == nil {
+			teams = top
+		}
+	}
+
+	names := make([]string, len(teams))
+	for i, t := range teams {
+		names[i] = t.Name
+	}
+	data, _ := json.Marshal(names)
+	return string(data), nil
+}
+
+// runToolLoop прогоняет диалог через provider.ChatWithTools, диспетчеризуя
+// tool_calls в registry и повторно вызывая модель с результатами инструментов,
+// пока она не вернёт финальный текстовый ответ (или пока не исчерпан лимит итераций).
+func runToolLoop(ctx context.Context, messages []Message, registry ToolRegistry) (string, error) {
+	if registry == nil {
+		return provider.Chat(ctx, messages)
+	}
+
+	for i := 0; i < maxToolLoopIterations; i++ {
+		assistantMsg, err := provider.ChatWithTools(ctx, messages, registry.Specs())
+		if err != nil {
+			return "", err
+		}
+
+		if len(assistantMsg.ToolCalls) == 0 {
+			return assistantMsg.Content, nil
+		}
+
+		messages = append(messages, assistantMsg)
+		for _, call := range assistantMsg.ToolCalls {
+			result, err := registry.Call(ctx, call.Function.Name, json.RawMessage(call.Function.Arguments))
+			if err != nil {
+				result = fmt.Sprintf("ошибка: %v", err)
+			}
+			messages = append(messages, Message{
+				Role:       "tool",
+				Content:    result,
+				ToolCallID: call.ID,
+				Name:       call.Function.Name,
+			})
+		}
+	}
+
+	return "", fmt.Errorf("превышен лимит итераций вызова инструментов (%d)", maxToolLoopIterations)
+}
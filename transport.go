@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// insecureTLS включается флагом --insecure и отключает проверку TLS-сертификатов.
+// Предназначен исключительно для локальной разработки за самоподписанным прокси.
+var insecureTLS bool
+
+const defaultRequestTimeout = 30 * time.Second
+
+// newHTTPClient собирает http.Client с системным пулом CA (плюс EXTRA_CA_CERTS
+// при наличии), прокси из окружения и ретраями на 429/5xx.
+func newHTTPClient(timeout time.Duration) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if insecureTLS {
+		tlsConfig.InsecureSkipVerify = true
+	} else {
+		pool, err := systemCertPoolWithExtras(os.Getenv("EXTRA_CA_CERTS"))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	base := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+
+	return &http.Client{
+		Transport: &retryTransport{base: base, maxRetries: 3},
+		Timeout:   timeout,
+	}, nil
+}
+
+func systemCertPoolWithExtras(extraCAFile string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if extraCAFile == "" {
+		return pool, nil
+	}
+
+	pem, err := ioutil.ReadFile(extraCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("чтение EXTRA_CA_CERTS: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("не удалось добавить сертификаты из %s", extraCAFile)
+	}
+
+	return pool, nil
+}
+
+// requestContext даёт отдельный от client.Timeout дедлайн на конкретный запрос,
+// управляемый REQUEST_TIMEOUT (в секундах, по умолчанию 20).
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := 20 * time.Second
+	if v := os.Getenv("REQUEST_TIMEOUT"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			timeout = time.Duration(secs) * time.Second
+		}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// retryTransport оборачивает базовый RoundTripper экспоненциальным бэкоффом
+// на 429/5xx, уважая Retry-After, если он присутствует в ответе.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	maxRetries := t.maxRetries
+	if maxRetries <= 0 {
+		maxRetries = 3
+	}
+
+	var bodyBytes []byte
+	if req.Body != nil {
+		bodyBytes, _ = ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 && req.Body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return resp, nil
+		}
+
+		wait := backoffDelay(attempt)
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("временная ошибка API: %d", resp.StatusCode)
+			// Читаем Retry-After и закрываем тело сразу после классификации ответа —
+			// до возможного break, иначе тело и соединение последней неудачной
+			// попытки никогда не освобождаются.
+			if ra := resp.Header.Get("Retry-After"); ra != "" {
+				if secs, err := strconv.Atoi(ra); err == nil {
+					wait = time.Duration(secs) * time.Second
+				}
+			}
+			resp.Body.Close()
+		}
+
+		if attempt == maxRetries {
+			break
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+
+	return nil, lastErr
+}
+
+func backoffDelay(attempt int) time.Duration {
+	base := 500 * time.Millisecond
+	return time.Duration(float64(base) * math.Pow(2, float64(attempt)))
+}